@@ -0,0 +1,332 @@
+// Package cassette records the HTTP exchanges the plugin has with the iot hub into
+// cassette files and replays them in tests.
+//
+// Both Recorder and Replayer are http.RoundTrippers, so they are installed as the
+// Transport of the plugin's http client. That client uses http.DefaultTransport, so
+// tests outside the plugin package swap that instead.
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ErrUnexpectedRequest is returned by the Replayer for requests without a matching
+// interaction in the cassette.
+var ErrUnexpectedRequest = errors.New("cassette: unexpected request")
+
+// redactedHeaders are not written to cassette files.
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Subscription-Key"}
+
+// redactedFields are not written to cassette files when they appear in form encoded
+// request bodies or at the top level of JSON bodies, e.g. OAuth token exchanges.
+var redactedFields = []string{
+	"access_token",
+	"actor_token",
+	"client_secret",
+	"id_token",
+	"refresh_token",
+	"subject_token",
+}
+
+const redacted = "REDACTED"
+
+// Cassette is a list of recorded HTTP interactions.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is a single request with the response it received.
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+type Response struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+// Load reads a cassette file.
+func Load(path string) (*Cassette, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cassette{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("cassette: error decoding %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Save writes the cassette to path.
+func (c *Cassette) Save(path string) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// Recorder passes requests to transport and records every exchange.
+type Recorder struct {
+	transport http.RoundTripper
+	mu        sync.Mutex
+	cassette  Cassette
+}
+
+// NewRecorder creates a Recorder around transport, http.DefaultTransport when nil.
+func NewRecorder(transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Recorder{transport: transport}
+}
+
+// Record creates a Recorder that writes its cassette to path when the test finishes.
+func Record(t testing.TB, path string, transport http.RoundTripper) *Recorder {
+	t.Helper()
+	rec := NewRecorder(transport)
+	t.Cleanup(func() {
+		if err := rec.Save(path); err != nil {
+			t.Errorf("error saving cassette: %v", err)
+		}
+	})
+	return rec
+}
+
+func (rec *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readBody(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	out := req.Clone(req.Context())
+	if reqBody != nil {
+		out.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := rec.transport.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := readBody(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.cassette.Interactions = append(rec.cassette.Interactions, Interaction{
+		Request: Request{
+			Method: req.Method,
+			URL:    req.URL.String(),
+			Header: redact(req.Header),
+			Body:   string(redactBody(req.Header, reqBody)),
+		},
+		Response: Response{
+			Status: resp.StatusCode,
+			Header: redact(resp.Header),
+			Body:   string(redactBody(resp.Header, respBody)),
+		},
+	})
+	return resp, nil
+}
+
+// Cassette returns a copy of the interactions recorded so far.
+func (rec *Recorder) Cassette() *Cassette {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return &Cassette{Interactions: append([]Interaction(nil), rec.cassette.Interactions...)}
+}
+
+// Save writes the interactions recorded so far to path.
+func (rec *Recorder) Save(path string) error {
+	return rec.Cassette().Save(path)
+}
+
+// Replayer serves responses from a cassette. A request is matched on method, path and
+// body against the interactions not served yet, in recording order. Redacted body
+// fields match any value.
+type Replayer struct {
+	t            testing.TB
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+// NewReplayer creates a Replayer for the interactions in c.
+func NewReplayer(c *Cassette) *Replayer {
+	return &Replayer{
+		interactions: c.Interactions,
+		used:         make([]bool, len(c.Interactions)),
+	}
+}
+
+// Replay loads the cassette at path and creates a Replayer that fails t on
+// unexpected requests.
+func Replay(t testing.TB, path string) *Replayer {
+	t.Helper()
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("error loading cassette: %v", err)
+	}
+	rep := NewReplayer(c)
+	rep.t = t
+	return rep
+}
+
+func (rep *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	for i, interaction := range rep.interactions {
+		if rep.used[i] || !matches(interaction.Request, req, redactBody(req.Header, body)) {
+			continue
+		}
+		rep.used[i] = true
+		return newResponse(req, interaction.Response), nil
+	}
+
+	err = fmt.Errorf("%w: %s %s %s", ErrUnexpectedRequest, req.Method, req.URL.Path, body)
+	if rep.t != nil {
+		rep.t.Errorf("%v", err)
+	}
+	return nil, err
+}
+
+// Unused returns the interactions that have not been served.
+func (rep *Replayer) Unused() []Interaction {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	var unused []Interaction
+	for i, interaction := range rep.interactions {
+		if !rep.used[i] {
+			unused = append(unused, interaction)
+		}
+	}
+	return unused
+}
+
+func matches(recorded Request, req *http.Request, body []byte) bool {
+	if recorded.Method != req.Method {
+		return false
+	}
+	u, err := url.Parse(recorded.URL)
+	if err != nil || u.Path != req.URL.Path {
+		return false
+	}
+	return bytes.Equal(normalize([]byte(recorded.Body)), normalize(body))
+}
+
+// normalize compacts JSON bodies so formatting differences do not break matching.
+func normalize(body []byte) []byte {
+	var b bytes.Buffer
+	if err := json.Compact(&b, body); err != nil {
+		return body
+	}
+	return b.Bytes()
+}
+
+func newResponse(req *http.Request, r Response) *http.Response {
+	header := r.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status)),
+		StatusCode:    r.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       req,
+	}
+}
+
+// readBody reads and closes body, which may be nil.
+func readBody(body io.ReadCloser) ([]byte, error) {
+	if body == nil || body == http.NoBody {
+		return nil, nil
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+func redact(header http.Header) http.Header {
+	header = header.Clone()
+	for _, h := range redactedHeaders {
+		if header.Get(h) != "" {
+			header.Set(h, redacted)
+		}
+	}
+	return header
+}
+
+// redactBody replaces the values of redactedFields in form encoded and JSON bodies.
+func redactBody(header http.Header, body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+	if strings.HasPrefix(header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return body
+		}
+		found := false
+		for _, f := range redactedFields {
+			if _, ok := form[f]; ok {
+				form.Set(f, redacted)
+				found = true
+			}
+		}
+		if !found {
+			return body
+		}
+		return []byte(form.Encode())
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	found := false
+	for _, f := range redactedFields {
+		if _, ok := fields[f]; ok {
+			fields[f] = json.RawMessage(`"` + redacted + `"`)
+			found = true
+		}
+	}
+	if !found {
+		return body
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return b
+}
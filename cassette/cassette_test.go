@@ -0,0 +1,191 @@
+package cassette
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordingTB captures the errors reported through it instead of failing the test.
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (tb *recordingTB) Helper() {}
+
+func (tb *recordingTB) Errorf(format string, args ...interface{}) {
+	tb.errors = append(tb.errors, fmt.Sprintf(format, args...))
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"path":%q,"body":%q}`, r.URL.Path, b)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func do(t *testing.T, rt http.RoundTripper, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("round trip: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	return resp, string(b)
+}
+
+func TestRecordReplay(t *testing.T) {
+	server := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	var recorded string
+	t.Run("record", func(t *testing.T) {
+		rec := Record(t, path, nil)
+		req, _ := http.NewRequest("POST", server.URL+"/device", strings.NewReader(`{"id": 1}`))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Cookie", "session=secret")
+		req.Header.Set("X-Subscription-Key", "secret")
+		body := req.Body
+
+		resp, b := do(t, rec, req)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusCreated)
+		}
+		if req.Body != body {
+			t.Error("recorder modified the caller's request body")
+		}
+		recorded = b
+	})
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("loading cassette: %v", err)
+	}
+	if len(c.Interactions) != 1 {
+		t.Fatalf("interactions = %d, want 1", len(c.Interactions))
+	}
+	interaction := c.Interactions[0]
+	for _, h := range []string{"Authorization", "Cookie", "X-Subscription-Key"} {
+		if got := interaction.Request.Header.Get(h); got != "REDACTED" {
+			t.Errorf("request header %s = %q, want REDACTED", h, got)
+		}
+	}
+	if got := interaction.Response.Header.Get("Set-Cookie"); got != "REDACTED" {
+		t.Errorf("response header Set-Cookie = %q, want REDACTED", got)
+	}
+
+	rep := Replay(t, path)
+	// Formatting differences in JSON bodies still match.
+	req, _ := http.NewRequest("POST", "http://elsewhere.test/device", strings.NewReader(`{"id":1}`))
+	resp, b := do(t, rep, req)
+	if resp.StatusCode != http.StatusCreated || b != recorded {
+		t.Errorf("replayed %d %q, want %d %q", resp.StatusCode, b, http.StatusCreated, recorded)
+	}
+	if unused := rep.Unused(); len(unused) != 0 {
+		t.Errorf("unused interactions = %d, want 0", len(unused))
+	}
+}
+
+func TestReplayUnexpectedRequest(t *testing.T) {
+	c := &Cassette{Interactions: []Interaction{{
+		Request:  Request{Method: "POST", URL: "http://hub.test/device", Body: `{"id":1}`},
+		Response: Response{Status: http.StatusOK},
+	}}}
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	if err := c.Save(path); err != nil {
+		t.Fatalf("saving cassette: %v", err)
+	}
+
+	tb := &recordingTB{TB: t}
+	rep := Replay(tb, path)
+
+	for _, req := range []*http.Request{
+		mustRequest(t, "GET", "http://hub.test/device", ""),
+		mustRequest(t, "POST", "http://hub.test/other", `{"id":1}`),
+		mustRequest(t, "POST", "http://hub.test/device", `{"id":2}`),
+	} {
+		_, err := rep.RoundTrip(req)
+		if !errors.Is(err, ErrUnexpectedRequest) {
+			t.Errorf("%s %s: err = %v, want ErrUnexpectedRequest", req.Method, req.URL.Path, err)
+		}
+	}
+	if len(tb.errors) != 3 {
+		t.Errorf("reported errors = %d, want 3", len(tb.errors))
+	}
+	if unused := rep.Unused(); len(unused) != 1 {
+		t.Errorf("unused interactions = %d, want 1", len(unused))
+	}
+
+	// Each interaction is served once.
+	do(t, rep, mustRequest(t, "POST", "http://hub.test/device", `{"id":1}`))
+	if _, err := rep.RoundTrip(mustRequest(t, "POST", "http://hub.test/device", `{"id":1}`)); !errors.Is(err, ErrUnexpectedRequest) {
+		t.Errorf("second replay: err = %v, want ErrUnexpectedRequest", err)
+	}
+}
+
+func mustRequest(t *testing.T, method, url, body string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	return req
+}
+
+func TestRecordRedactsTokenExchange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"hub-secret","token_type":"Bearer","expires_in":3600}`))
+	}))
+	t.Cleanup(server.Close)
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	exchange := func(rt http.RoundTripper, subjectToken string) string {
+		form := url.Values{"grant_type": {"token-exchange"}, "subject_token": {subjectToken}}
+		req := mustRequest(t, "POST", server.URL+"/token", form.Encode())
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		_, b := do(t, rt, req)
+		return b
+	}
+
+	rec := NewRecorder(nil)
+	if got := exchange(rec, "user-secret"); !strings.Contains(got, "hub-secret") {
+		t.Errorf("recorder changed the live response: %q", got)
+	}
+	if err := rec.Save(path); err != nil {
+		t.Fatalf("saving cassette: %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading cassette: %v", err)
+	}
+	for _, secret := range []string{"user-secret", "hub-secret"} {
+		if strings.Contains(string(b), secret) {
+			t.Errorf("cassette contains %q:\n%s", secret, b)
+		}
+	}
+
+	// Redacted fields match any value on replay.
+	rep := Replay(t, path)
+	if got := exchange(rep, "another-user-token"); !strings.Contains(got, `"access_token":"REDACTED"`) {
+		t.Errorf("replayed body = %q", got)
+	}
+}
@@ -0,0 +1,46 @@
+package cassette_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	simulated "github.com/bdstark/traefik-create-simulated"
+	"github.com/bdstark/traefik-create-simulated/cassette"
+)
+
+// These tests live outside the plugin package, which is also interpreted by Yaegi,
+// and reach the plugin's http client through http.DefaultTransport.
+func useTransport(t *testing.T, rt http.RoundTripper) {
+	t.Helper()
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = rt
+	t.Cleanup(func() { http.DefaultTransport = defaultTransport })
+}
+
+func TestPluginReplay(t *testing.T) {
+	replayer := cassette.Replay(t, "testdata/link.json")
+	useTransport(t, replayer)
+
+	nextCalled := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { nextCalled = true })
+	config := simulated.CreateConfig()
+	config.IotHubUrl = "http://iothub.test"
+	handler, err := simulated.New(context.Background(), next, config, "test")
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+
+	body := `{"deviceLinkOperation":{"identifier":"hw-1","product":"TRACKER"}}`
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/link", strings.NewReader(body)))
+
+	if w.Code != http.StatusOK || !nextCalled {
+		t.Errorf("status = %d, next called = %v", w.Code, nextCalled)
+	}
+	if unused := replayer.Unused(); len(unused) != 0 {
+		t.Errorf("unused interactions = %d, want 0", len(unused))
+	}
+}
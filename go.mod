@@ -1,3 +1,3 @@
 module github.com/bdstark/traefik-create-simulated
 
-go 1.16
+go 1.18
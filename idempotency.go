@@ -0,0 +1,247 @@
+package traefik_create_simulated
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+
+	// idempotencyReservationTimeout bounds how long a key stays reserved by a request
+	// that never completes or abandons it.
+	idempotencyReservationTimeout = 5 * time.Minute
+	// idempotencySweepInterval is how often expired entries are removed.
+	idempotencySweepInterval = time.Minute
+
+	defaultIdempotencyMaxEntries  = 10000
+	defaultIdempotencyMaxBodySize = 1 << 20
+)
+
+// idempotencyCredentialHeaders identify the caller a key belongs to.
+var idempotencyCredentialHeaders = []string{"Authorization", "X-Subscription-Key", "Cookie"}
+
+// idempotencyStore keeps the downstream responses of completed requests keyed by
+// their client supplied idempotency key.
+type idempotencyStore struct {
+	ttl         time.Duration
+	maxEntries  int
+	maxBodySize int
+
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	nextSweep time.Time
+}
+
+type idempotencyEntry struct {
+	fingerprint string
+	completed   bool
+	expires     time.Time
+	status      int
+	header      http.Header
+	body        []byte
+}
+
+type idempotencyState int
+
+const (
+	idempotencyNew idempotencyState = iota
+	idempotencyReplay
+	idempotencyInProgress
+	idempotencyConflict
+	// idempotencyFull means the store has no room left; the request is processed
+	// without being stored.
+	idempotencyFull
+)
+
+func newIdempotencyStore(ttl time.Duration, maxEntries, maxBodySize int) *idempotencyStore {
+	if maxEntries <= 0 {
+		maxEntries = defaultIdempotencyMaxEntries
+	}
+	if maxBodySize <= 0 {
+		maxBodySize = defaultIdempotencyMaxBodySize
+	}
+	return &idempotencyStore{
+		ttl:         ttl,
+		maxEntries:  maxEntries,
+		maxBodySize: maxBodySize,
+		entries:     map[string]*idempotencyEntry{},
+	}
+}
+
+// begin reserves key for a request with the given fingerprint. The returned entry is
+// the new reservation for idempotencyNew and the stored response for
+// idempotencyReplay.
+func (store *idempotencyStore) begin(key, fingerprint string) (*idempotencyEntry, idempotencyState) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	if now.After(store.nextSweep) {
+		for k, entry := range store.entries {
+			if now.After(entry.expires) {
+				delete(store.entries, k)
+			}
+		}
+		store.nextSweep = now.Add(idempotencySweepInterval)
+	}
+
+	entry, ok := store.entries[key]
+	if ok && now.After(entry.expires) {
+		delete(store.entries, key)
+		ok = false
+	}
+	if !ok {
+		if len(store.entries) >= store.maxEntries {
+			return nil, idempotencyFull
+		}
+		entry = &idempotencyEntry{
+			fingerprint: fingerprint,
+			expires:     now.Add(idempotencyReservationTimeout),
+		}
+		store.entries[key] = entry
+		return entry, idempotencyNew
+	}
+	if entry.fingerprint != fingerprint {
+		return nil, idempotencyConflict
+	}
+	if !entry.completed {
+		return nil, idempotencyInProgress
+	}
+	return entry, idempotencyReplay
+}
+
+// complete stores the recorded response in the reservation so retries can replay
+// it. Reservations that have already been swept are ignored, and responses larger
+// than the body size limit release the reservation instead.
+func (store *idempotencyStore) complete(key string, entry *idempotencyEntry, rec *responseRecorder) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.entries[key] != entry {
+		return
+	}
+	if rec.overflow {
+		logWarn("idempotent response exceeds %d bytes, not stored", store.maxBodySize)
+		delete(store.entries, key)
+		return
+	}
+	entry.completed = true
+	entry.expires = time.Now().Add(store.ttl)
+	entry.status = rec.status
+	entry.header = rec.header
+	if entry.status == 0 {
+		entry.status = http.StatusOK
+		entry.header = rec.ResponseWriter.Header().Clone()
+	}
+	entry.body = rec.body.Bytes()
+}
+
+// abandon releases the reservation so a retry is processed again.
+func (store *idempotencyStore) abandon(key string, entry *idempotencyEntry) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.entries[key] == entry && !entry.completed {
+		delete(store.entries, key)
+	}
+}
+
+func (entry *idempotencyEntry) replay(w http.ResponseWriter) {
+	for h, v := range entry.header {
+		w.Header()[h] = append([]string(nil), v...)
+	}
+	w.Header().Set(idempotencyReplayedHeader, "true")
+	w.WriteHeader(entry.status)
+	_, _ = w.Write(entry.body)
+}
+
+// idempotencyStoreKey scopes the client supplied key to the caller, so callers with
+// different credentials never share stored responses. Callers are told apart by the
+// credential headers only; deployments authenticating otherwise share one key space.
+func idempotencyStoreKey(r *http.Request, key string) string {
+	h := sha256.New()
+	writeCredentials(h, r)
+	h.Write([]byte(key))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func idempotencyFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	writeCredentials(h, r)
+	h.Write([]byte(r.Method))
+	h.Write([]byte{0})
+	h.Write([]byte(r.URL.RequestURI()))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeCredentials(h hash.Hash, r *http.Request) {
+	for _, header := range idempotencyCredentialHeaders {
+		for _, v := range r.Header.Values(header) {
+			h.Write([]byte(v))
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{0})
+	}
+}
+
+// responseRecorder passes the response through to the client while keeping a copy of
+// it for the idempotency store. Bodies over maxBodySize are not kept.
+type responseRecorder struct {
+	http.ResponseWriter
+	maxBodySize int
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	overflow    bool
+}
+
+func newResponseRecorder(w http.ResponseWriter, maxBodySize int) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, maxBodySize: maxBodySize}
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status != 0 {
+		return
+	}
+	// Informational responses such as 103 Early Hints precede the final status.
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		rec.ResponseWriter.WriteHeader(status)
+		return
+	}
+	rec.status = status
+	rec.header = rec.ResponseWriter.Header().Clone()
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if rec.body.Len()+len(b) > rec.maxBodySize {
+			rec.overflow = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *responseRecorder) Flush() {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,273 @@
+package traefik_create_simulated
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newIdempotentPlugin(t *testing.T, hub *testHub, next http.Handler) *SimulatedPlugin {
+	t.Helper()
+	config := CreateConfig()
+	config.IotHubUrl = hub.URL
+	config.IdempotencyTTL = "1h"
+	return newTestPlugin(t, config, next)
+}
+
+func newLimitedIdempotentPlugin(t *testing.T, hub *testHub, maxEntries, maxBodySize int, next http.Handler) *SimulatedPlugin {
+	t.Helper()
+	config := CreateConfig()
+	config.IotHubUrl = hub.URL
+	config.IdempotencyTTL = "1h"
+	config.IdempotencyMaxEntries = maxEntries
+	config.IdempotencyMaxBodySize = maxBodySize
+	return newTestPlugin(t, config, next)
+}
+
+func idempotentRequest(key, authorization, body string) *http.Request {
+	r := httptest.NewRequest("POST", "/link", strings.NewReader(body))
+	r.Header.Set(idempotencyKeyHeader, key)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	return r
+}
+
+func TestIdempotency_Replay(t *testing.T) {
+	hub := newTestHub(t, nil)
+	nextCalls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nextCalls++
+		w.Header().Set("X-Thing", "thing-1")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("created"))
+	})
+	plugin := newIdempotentPlugin(t, hub, next)
+
+	first := serve(plugin, idempotentRequest("key-1", "Bearer a", linkBody("hw-1")))
+	retry := serve(plugin, idempotentRequest("key-1", "Bearer a", linkBody("hw-1")))
+
+	if nextCalls != 1 || len(hub.requests) != 1 {
+		t.Fatalf("next calls = %d, hub calls = %d, want 1 and 1", nextCalls, len(hub.requests))
+	}
+	if first.Header().Get(idempotencyReplayedHeader) != "" {
+		t.Error("first response marked as replayed")
+	}
+	if retry.Code != http.StatusCreated || retry.Body.String() != "created" || retry.Header().Get("X-Thing") != "thing-1" {
+		t.Errorf("replayed response = %d %q %v", retry.Code, retry.Body.String(), retry.Header())
+	}
+	if retry.Header().Get(idempotencyReplayedHeader) != "true" {
+		t.Error("replayed response not marked as replayed")
+	}
+	if key := hub.requests[0].header.Get(idempotencyKeyHeader); key != "" {
+		t.Errorf("hub received Idempotency-Key %q", key)
+	}
+}
+
+func TestIdempotency_Conflict(t *testing.T) {
+	hub := newTestHub(t, nil)
+	plugin := newIdempotentPlugin(t, hub, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve(plugin, idempotentRequest("key-1", "", linkBody("hw-1")))
+	w := serve(plugin, idempotentRequest("key-1", "", linkBody("hw-2")))
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	if len(hub.requests) != 1 {
+		t.Errorf("hub calls = %d, want 1", len(hub.requests))
+	}
+}
+
+func TestIdempotency_ConflictOnQuery(t *testing.T) {
+	hub := newTestHub(t, nil)
+	plugin := newIdempotentPlugin(t, hub, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	first := idempotentRequest("key-1", "", linkBody("hw-1"))
+	first.URL.RawQuery = "x=1"
+	retry := idempotentRequest("key-1", "", linkBody("hw-1"))
+	retry.URL.RawQuery = "x=2"
+	serve(plugin, first)
+
+	if w := serve(plugin, retry); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestIdempotency_ScopedByCaller(t *testing.T) {
+	hub := newTestHub(t, nil)
+	nextCalls := 0
+	plugin := newIdempotentPlugin(t, hub, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { nextCalls++ }))
+
+	serve(plugin, idempotentRequest("key-1", "Bearer alice", linkBody("hw-1")))
+	w := serve(plugin, idempotentRequest("key-1", "Bearer mallory", linkBody("hw-1")))
+
+	if w.Header().Get(idempotencyReplayedHeader) != "" {
+		t.Error("response of another caller replayed")
+	}
+	if nextCalls != 2 {
+		t.Errorf("next calls = %d, want 2", nextCalls)
+	}
+}
+
+func TestIdempotency_ScopedBySubscriptionKey(t *testing.T) {
+	hub := newTestHub(t, nil)
+	nextCalls := 0
+	plugin := newIdempotentPlugin(t, hub, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { nextCalls++ }))
+
+	for _, subscriptionKey := range []string{"alice", "mallory"} {
+		r := idempotentRequest("key-1", "", linkBody("hw-1"))
+		r.Header.Set("X-Subscription-Key", subscriptionKey)
+		if w := serve(plugin, r); w.Header().Get(idempotencyReplayedHeader) != "" {
+			t.Error("response of another caller replayed")
+		}
+	}
+	if nextCalls != 2 {
+		t.Errorf("next calls = %d, want 2", nextCalls)
+	}
+}
+
+func TestIdempotency_EarlyHints(t *testing.T) {
+	hub := newTestHub(t, nil)
+	plugin := newIdempotentPlugin(t, hub, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("created"))
+	}))
+	server := httptest.NewServer(plugin)
+	t.Cleanup(server.Close)
+
+	for _, replayed := range []string{"", "true"} {
+		req, _ := http.NewRequest("POST", server.URL+"/link", strings.NewReader(linkBody("hw-1")))
+		req.Header.Set(idempotencyKeyHeader, "key-1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated || string(b) != "created" {
+			t.Errorf("response = %d %q, want %d %q", resp.StatusCode, b, http.StatusCreated, "created")
+		}
+		if got := resp.Header.Get(idempotencyReplayedHeader); got != replayed {
+			t.Errorf("%s = %q, want %q", idempotencyReplayedHeader, got, replayed)
+		}
+	}
+}
+
+func TestIdempotency_MaxBodySize(t *testing.T) {
+	hub := newTestHub(t, nil)
+	nextCalls := 0
+	plugin := newLimitedIdempotentPlugin(t, hub, 10, 4, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nextCalls++
+		_, _ = w.Write([]byte("too large"))
+	}))
+
+	for i := 0; i < 2; i++ {
+		w := serve(plugin, idempotentRequest("key-1", "", linkBody("hw-1")))
+		if w.Body.String() != "too large" || w.Header().Get(idempotencyReplayedHeader) != "" {
+			t.Errorf("response = %q %v, want the full body, not replayed", w.Body.String(), w.Header())
+		}
+	}
+	if nextCalls != 2 {
+		t.Errorf("next calls = %d, want 2", nextCalls)
+	}
+	if n := len(plugin.idempotency.entries); n != 0 {
+		t.Errorf("stored entries = %d, want 0", n)
+	}
+}
+
+func TestIdempotency_MaxEntries(t *testing.T) {
+	hub := newTestHub(t, nil)
+	nextCalls := 0
+	plugin := newLimitedIdempotentPlugin(t, hub, 1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { nextCalls++ }))
+
+	serve(plugin, idempotentRequest("key-1", "", linkBody("hw-1")))
+	serve(plugin, idempotentRequest("key-2", "", linkBody("hw-1")))
+	serve(plugin, idempotentRequest("key-2", "", linkBody("hw-1")))
+	w := serve(plugin, idempotentRequest("key-1", "", linkBody("hw-1")))
+
+	if nextCalls != 3 {
+		t.Errorf("next calls = %d, want 3", nextCalls)
+	}
+	if w.Header().Get(idempotencyReplayedHeader) != "true" {
+		t.Error("stored response not replayed")
+	}
+	if n := len(plugin.idempotency.entries); n != 1 {
+		t.Errorf("stored entries = %d, want 1", n)
+	}
+}
+
+func TestIdempotency_FailureReleasesKey(t *testing.T) {
+	fail := true
+	hub := newTestHub(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	plugin := newIdempotentPlugin(t, hub, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	if w := serve(plugin, idempotentRequest("key-1", "", linkBody("hw-1"))); w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	fail = false
+	if w := serve(plugin, idempotentRequest("key-1", "", linkBody("hw-1"))); w.Code != http.StatusOK {
+		t.Errorf("retry status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if len(hub.requests) != 2 {
+		t.Errorf("hub calls = %d, want 2", len(hub.requests))
+	}
+}
+
+func TestIdempotency_PanicReleasesKey(t *testing.T) {
+	hub := newTestHub(t, nil)
+	panics := true
+	plugin := newIdempotentPlugin(t, hub, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if panics {
+			panic(http.ErrAbortHandler)
+		}
+	}))
+
+	func() {
+		defer func() {
+			if err, _ := recover().(error); !errors.Is(err, http.ErrAbortHandler) {
+				t.Errorf("recovered %v, want http.ErrAbortHandler", err)
+			}
+		}()
+		serve(plugin, idempotentRequest("key-1", "", linkBody("hw-1")))
+	}()
+
+	panics = false
+	if w := serve(plugin, idempotentRequest("key-1", "", linkBody("hw-1"))); w.Code != http.StatusOK {
+		t.Errorf("retry status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestIdempotencyStore_ReservationExpires(t *testing.T) {
+	store := newIdempotencyStore(time.Hour, 0, 0)
+
+	entry, state := store.begin("key-1", "fingerprint")
+	if state != idempotencyNew {
+		t.Fatalf("state = %v, want idempotencyNew", state)
+	}
+	if _, state := store.begin("key-1", "fingerprint"); state != idempotencyInProgress {
+		t.Fatalf("state = %v, want idempotencyInProgress", state)
+	}
+
+	entry.expires = time.Now().Add(-time.Second)
+	next, state := store.begin("key-1", "fingerprint")
+	if state != idempotencyNew {
+		t.Fatalf("state after deadline = %v, want idempotencyNew", state)
+	}
+
+	// The stale request completing late must not overwrite the new reservation.
+	store.complete("key-1", entry, newResponseRecorder(httptest.NewRecorder(), defaultIdempotencyMaxBodySize))
+	if next.completed {
+		t.Error("stale completion applied to the new reservation")
+	}
+}
@@ -0,0 +1,61 @@
+package traefik_create_simulated
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// serveLazy creates the simulated device the first time a request references its
+// hardware ID. Requests without a hardware ID are passed to next untouched.
+func (plugin *SimulatedPlugin) serveLazy(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	op, ok := plugin.extractDevice(r, body)
+	if !ok {
+		plugin.forward(w, r, body)
+		return true
+	}
+
+	err := plugin.devices.ensure(r.Context(), string(op.HardwareId), func() error {
+		logWarn("found unknown deviceId=%s", op.HardwareId)
+		err := plugin.createSimulatedDevice(r, op)
+		// The simulator may have been created by another replica or before a restart.
+		if isHubStatus(err, http.StatusConflict) {
+			logInfo("iot hub device already exists: %s", op.HardwareId)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		logError("%v", err)
+		http.NotFound(w, r)
+		return false
+	}
+
+	plugin.forward(w, r, body)
+	return true
+}
+
+// extractDevice finds the device referenced by the request, from a device link in the
+// body or else from the request path.
+func (plugin *SimulatedPlugin) extractDevice(r *http.Request, body []byte) (DeviceLinkOperation, bool) {
+	op := DeviceLinkOperation{}
+
+	cr := &CreateThingRequest{}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(cr); err == nil {
+		op = cr.DeviceLinkOperation
+	}
+
+	if op.HardwareId == "" && plugin.hardwareIdPattern != nil {
+		if m := plugin.hardwareIdPattern.FindStringSubmatch(r.URL.Path); len(m) > 1 {
+			op.HardwareId = HardwareId(m[1])
+		}
+	}
+	if op.HardwareId == "" {
+		return op, false
+	}
+
+	if op.Product == "" {
+		op.Product = plugin.defaultProduct
+	}
+	return op, true
+}
@@ -0,0 +1,175 @@
+package traefik_create_simulated
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newLazyPlugin(t *testing.T, hub *testHub) *SimulatedPlugin {
+	t.Helper()
+	config := CreateConfig()
+	config.IotHubUrl = hub.URL
+	config.TriggerMode = TriggerModeLazy
+	config.HardwareIdPathPattern = "^/devices/([^/]+)"
+	return newTestPlugin(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+func TestLazy_CreatesOnFirstAccess(t *testing.T) {
+	hub := newTestHub(t, nil)
+	plugin := newLazyPlugin(t, hub)
+
+	for _, path := range []string{"/devices/hw-1/status", "/devices/hw-1/status", "/health"} {
+		if w := serve(plugin, httptest.NewRequest("GET", path, nil)); w.Code != http.StatusOK {
+			t.Errorf("GET %s status = %d, want %d", path, w.Code, http.StatusOK)
+		}
+	}
+
+	if len(hub.requests) != 1 {
+		t.Fatalf("hub calls = %d, want 1", len(hub.requests))
+	}
+	if want := `{"hardwareId":"hw-1","productId":"TRACKER","simulatorType":"MANUAL"}` + "\n"; hub.requests[0].body != want {
+		t.Errorf("hub body = %q, want %q", hub.requests[0].body, want)
+	}
+}
+
+func TestLazy_ExtractsFromDeviceLink(t *testing.T) {
+	hub := newTestHub(t, nil)
+	plugin := newLazyPlugin(t, hub)
+
+	body := `{"deviceLinkOperation":{"identifier":"hw-2","product":"COLLAR"}}`
+	serve(plugin, httptest.NewRequest("POST", "/link", strings.NewReader(body)))
+
+	if len(hub.requests) != 1 {
+		t.Fatalf("hub calls = %d, want 1", len(hub.requests))
+	}
+	if want := `{"hardwareId":"hw-2","productId":"COLLAR","simulatorType":"MANUAL"}` + "\n"; hub.requests[0].body != want {
+		t.Errorf("hub body = %q, want %q", hub.requests[0].body, want)
+	}
+}
+
+func TestLazy_ExistingDevice(t *testing.T) {
+	hub := newTestHub(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	})
+	plugin := newLazyPlugin(t, hub)
+
+	for i := 0; i < 2; i++ {
+		if w := serve(plugin, httptest.NewRequest("GET", "/devices/hw-1/status", nil)); w.Code != http.StatusOK {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+	if len(hub.requests) != 1 {
+		t.Errorf("hub calls = %d, want 1", len(hub.requests))
+	}
+}
+
+func TestLazy_FailedCreationIsRetried(t *testing.T) {
+	fail := true
+	hub := newTestHub(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	plugin := newLazyPlugin(t, hub)
+
+	if w := serve(plugin, httptest.NewRequest("GET", "/devices/hw-1/status", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	fail = false
+	if w := serve(plugin, httptest.NewRequest("GET", "/devices/hw-1/status", nil)); w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if len(hub.requests) != 2 {
+		t.Errorf("hub calls = %d, want 2", len(hub.requests))
+	}
+}
+
+func TestLazy_ConcurrentFirstAccess(t *testing.T) {
+	release := make(chan struct{})
+	hub := newTestHub(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	plugin := newLazyPlugin(t, hub)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(plugin, httptest.NewRequest("GET", "/devices/hw-1/status", nil))
+		}()
+	}
+	// Hold the first creation at the hub while the other requests pile up behind it.
+	for len(hub.paths()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if paths := hub.paths(); len(paths) != 1 {
+		t.Errorf("hub calls = %d, want 1", len(paths))
+	}
+}
+
+func TestLazy_WaiterGivesUpWhenClientLeaves(t *testing.T) {
+	release := make(chan struct{})
+	hub := newTestHub(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	plugin := newLazyPlugin(t, hub)
+
+	first := make(chan struct{})
+	go func() {
+		defer close(first)
+		serve(plugin, httptest.NewRequest("GET", "/devices/hw-1/status", nil))
+	}()
+	for len(hub.paths()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	waiter := make(chan int)
+	go func() {
+		r := httptest.NewRequest("GET", "/devices/hw-1/status", nil).WithContext(ctx)
+		waiter <- serve(plugin, r).Code
+	}()
+
+	select {
+	case code := <-waiter:
+		if code != http.StatusNotFound {
+			t.Errorf("status = %d, want %d", code, http.StatusNotFound)
+		}
+	case <-time.After(time.Second):
+		t.Error("waiter still blocked after its client left")
+	}
+	close(release)
+	<-first
+}
+
+func TestLazy_RequiresPathPattern(t *testing.T) {
+	config := CreateConfig()
+	config.TriggerMode = TriggerModeLazy
+	if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+		t.Error("lazy mode without a hardware id path pattern accepted")
+	}
+}
+
+func TestLink_DoesNotRecordDevices(t *testing.T) {
+	hub := newTestHub(t, nil)
+	config := CreateConfig()
+	config.IotHubUrl = hub.URL
+	plugin := newTestPlugin(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve(plugin, httptest.NewRequest("POST", "/link", strings.NewReader(linkBody("hw-1"))))
+
+	if len(plugin.devices.done) != 0 {
+		t.Errorf("recorded devices = %d, want 0", len(plugin.devices.done))
+	}
+}
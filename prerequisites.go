@@ -0,0 +1,78 @@
+package traefik_create_simulated
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// prerequisites lists per product the hub resources, such as the product itself and
+// its simulator template, that must exist before simulated devices can be created.
+//
+//	{
+//	  "TRACKER": [
+//	    {"path": "/simulator/product", "body": {"productId": "TRACKER"}},
+//	    {"path": "/simulator/simulated/template", "body": {"productId": "TRACKER"}}
+//	  ]
+//	}
+type prerequisites map[Product][]prerequisite
+
+// prerequisite is a single hub resource, created by posting body to path.
+type prerequisite struct {
+	Path string          `json:"path"`
+	Body json.RawMessage `json:"body"`
+}
+
+func loadPrerequisites(path string) (prerequisites, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading prerequisites file: %w", err)
+	}
+	p := prerequisites{}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("error decoding prerequisites file: %w", err)
+	}
+	return p, nil
+}
+
+// missingPrerequisites reports whether err is the hub telling that the product or
+// its simulator template does not exist yet.
+func (plugin *SimulatedPlugin) missingPrerequisites(err error) bool {
+	if plugin.prerequisites == nil {
+		return false
+	}
+	var statusErr *hubStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		return false
+	}
+	for _, code := range plugin.prerequisiteErrorCodes {
+		if statusErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// provisionPrerequisites creates the hub resources defined for product, in order.
+// Resources the hub reports as already existing are skipped.
+func (plugin *SimulatedPlugin) provisionPrerequisites(r *http.Request, product Product) error {
+	defs, ok := plugin.prerequisites[product]
+	if !ok {
+		return fmt.Errorf("no prerequisites defined for product %s", product)
+	}
+
+	for _, def := range defs {
+		_, err := plugin.postToHub(r, def.Path, def.Body)
+		if isHubStatus(err, http.StatusConflict) {
+			logInfo("iot hub prerequisite %s already exists", def.Path)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error creating iot hub prerequisite %s: %w", def.Path, err)
+		}
+		logInfo("iot hub prerequisite %s created for product=%s", def.Path, product)
+	}
+	return nil
+}
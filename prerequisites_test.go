@@ -0,0 +1,198 @@
+package traefik_create_simulated
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testPrerequisites = `{
+  "TRACKER": [
+    {"path": "/simulator/product", "body": {"productId": "TRACKER"}},
+    {"path": "/simulator/simulated/template", "body": {"productId": "TRACKER"}}
+  ]
+}`
+
+func newPrerequisitesPlugin(t *testing.T, hub *testHub) *SimulatedPlugin {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "prerequisites.json")
+	if err := os.WriteFile(path, []byte(testPrerequisites), 0o600); err != nil {
+		t.Fatalf("writing prerequisites file: %v", err)
+	}
+	config := CreateConfig()
+	config.IotHubUrl = hub.URL
+	config.PrerequisitesFile = path
+	return newTestPlugin(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+// writeMissingTemplate answers like a hub without the product's simulator template.
+func writeMissingTemplate(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	_, _ = w.Write([]byte(`{"code":"SIMULATOR_TEMPLATE_NOT_FOUND","message":"no template for product"}`))
+}
+
+func TestPrerequisites_ProvisionAndRetry(t *testing.T) {
+	provisioned := false
+	hub := newTestHub(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/simulator/product":
+			w.WriteHeader(http.StatusConflict)
+		case "/simulator/simulated/template":
+			provisioned = true
+		default:
+			if !provisioned {
+				writeMissingTemplate(w)
+			}
+		}
+	})
+	plugin := newPrerequisitesPlugin(t, hub)
+
+	w := serve(plugin, httptest.NewRequest("POST", "/link", strings.NewReader(linkBody("hw-1"))))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	want := []string{
+		"/simulator/simulated/device",
+		"/simulator/product",
+		"/simulator/simulated/template",
+		"/simulator/simulated/device",
+	}
+	if got := hub.paths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("hub paths = %v, want %v", got, want)
+	}
+	if got := hub.requests[2].body; got != `{"productId": "TRACKER"}` {
+		t.Errorf("template body = %q", got)
+	}
+
+	// The product is provisioned now, so the next device is created directly.
+	provisioned = false
+	serve(plugin, httptest.NewRequest("POST", "/link", strings.NewReader(linkBody("hw-2"))))
+	if got := hub.paths()[len(want):]; len(got) != 2 || got[0] != "/simulator/simulated/device" || got[1] != "/simulator/simulated/device" {
+		t.Errorf("hub paths for second device = %v, want two device creations", got)
+	}
+}
+
+func TestPrerequisites_OtherNotFound(t *testing.T) {
+	hub := newTestHub(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	plugin := newPrerequisitesPlugin(t, hub)
+
+	w := serve(plugin, httptest.NewRequest("POST", "/link", strings.NewReader(linkBody("hw-1"))))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if got := hub.paths(); len(got) != 1 {
+		t.Errorf("hub paths = %v, want only the device creation", got)
+	}
+}
+
+func TestPrerequisites_ConcurrentProvisioning(t *testing.T) {
+	var mu sync.Mutex
+	provisioned := false
+	release := make(chan struct{})
+	hub := newTestHub(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/simulator/product":
+			<-release
+		case "/simulator/simulated/template":
+			mu.Lock()
+			provisioned = true
+			mu.Unlock()
+		default:
+			mu.Lock()
+			defer mu.Unlock()
+			if !provisioned {
+				writeMissingTemplate(w)
+			}
+		}
+	})
+	plugin := newPrerequisitesPlugin(t, hub)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := linkBody(fmt.Sprintf("hw-%d", i))
+			if w := serve(plugin, httptest.NewRequest("POST", "/link", strings.NewReader(body))); w.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+		}(i)
+	}
+	// Hold the provisioning at the hub while the other requests pile up behind it.
+	for count(hub.paths(), "/simulator/product") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := count(hub.paths(), "/simulator/product"); n != 1 {
+		t.Errorf("product provisioned %d times, want 1", n)
+	}
+}
+
+func count(paths []string, path string) int {
+	n := 0
+	for _, p := range paths {
+		if p == path {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPrerequisites_RetriesOnce(t *testing.T) {
+	hub := newTestHub(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/simulator/simulated/device" {
+			writeMissingTemplate(w)
+		}
+	})
+	plugin := newPrerequisitesPlugin(t, hub)
+
+	w := serve(plugin, httptest.NewRequest("POST", "/link", strings.NewReader(linkBody("hw-1"))))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if got := hub.paths(); len(got) != 4 {
+		t.Errorf("hub paths = %v, want 4 calls", got)
+	}
+}
+
+func TestPrerequisites_UnknownProduct(t *testing.T) {
+	hub := newTestHub(t, func(w http.ResponseWriter, r *http.Request) {
+		writeMissingTemplate(w)
+	})
+	plugin := newPrerequisitesPlugin(t, hub)
+
+	body := `{"deviceLinkOperation":{"identifier":"hw-1","product":"COLLAR"}}`
+	w := serve(plugin, httptest.NewRequest("POST", "/link", strings.NewReader(body)))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if got := hub.paths(); len(got) != 1 {
+		t.Errorf("hub paths = %v, want only the device creation", got)
+	}
+}
+
+func TestPrerequisites_InvalidFile(t *testing.T) {
+	config := CreateConfig()
+	config.PrerequisitesFile = filepath.Join(t.TempDir(), "missing.json")
+	if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+		t.Error("missing prerequisites file accepted")
+	}
+}
@@ -0,0 +1,66 @@
+package traefik_create_simulated
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ensureRegistry remembers which keys have been set up, such as the devices created
+// in lazy mode or the products provisioned on the hub, and runs each set up once.
+type ensureRegistry struct {
+	mu      sync.Mutex
+	done    map[string]struct{}
+	running map[string]*ensureCall
+}
+
+// ensureCall is a set up in flight.
+type ensureCall struct {
+	done chan struct{}
+	err  error
+}
+
+var errEnsureAborted = errors.New("set up aborted")
+
+func newEnsureRegistry() *ensureRegistry {
+	return &ensureRegistry{
+		done:    map[string]struct{}{},
+		running: map[string]*ensureCall{},
+	}
+}
+
+// ensure runs fn unless key is already set up. Concurrent calls for the same key wait
+// for the call in flight, or until ctx is done, and share its result. A failed call
+// is attempted again by the next one.
+func (registry *ensureRegistry) ensure(ctx context.Context, key string, fn func() error) error {
+	registry.mu.Lock()
+	if _, ok := registry.done[key]; ok {
+		registry.mu.Unlock()
+		return nil
+	}
+	if c, ok := registry.running[key]; ok {
+		registry.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	c := &ensureCall{done: make(chan struct{}), err: errEnsureAborted}
+	registry.running[key] = c
+	registry.mu.Unlock()
+
+	defer func() {
+		registry.mu.Lock()
+		delete(registry.running, key)
+		if c.err == nil {
+			registry.done[key] = struct{}{}
+		}
+		registry.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.err = fn()
+	return c.err
+}
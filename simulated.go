@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
 	"time"
 )
 
@@ -15,10 +17,50 @@ import (
 type Config struct {
 	IotHubUrl       string
 	SubscriptionKey string
+	// IdempotencyTTL enables replaying responses for requests carrying an
+	// Idempotency-Key header, e.g. "24h". Empty disables it. Keys are scoped by the
+	// caller's Authorization, X-Subscription-Key and Cookie headers.
+	IdempotencyTTL string
+	// IdempotencyMaxEntries caps the number of stored responses. Requests arriving
+	// while the store is full are processed without being stored.
+	IdempotencyMaxEntries int
+	// IdempotencyMaxBodySize caps the size in bytes of a stored response body. Larger
+	// responses are passed through but not stored.
+	IdempotencyMaxBodySize int
+	// TriggerMode selects which requests create simulators: "link" for device link
+	// requests, "lazy" for any request referencing a hardware ID not seen before.
+	TriggerMode TriggerMode
+	// HardwareIdPathPattern extracts the hardware ID from the first capture group of
+	// the request path in lazy mode, e.g. "^/devices/([^/]+)". Required in lazy mode.
+	HardwareIdPathPattern string
+	// DefaultProduct is used in lazy mode when the request does not name a product.
+	DefaultProduct Product
+	// PrerequisitesFile points to a JSON file with the hub resources each product
+	// needs. When set, they are created once per product when the hub answers a device
+	// creation with 404 Not Found and one of PrerequisiteErrorCodes, and the creation
+	// is retried once.
+	PrerequisitesFile string
+	// PrerequisiteErrorCodes are the values of the "code" field in the hub's error
+	// body that report a missing product or simulator template.
+	PrerequisiteErrorCodes []string
+	// TokenExchangeUrl enables creating simulators on behalf of the calling user. The
+	// bearer token of the request is exchanged at this endpoint (RFC 8693) for a hub
+	// scoped token, which replaces the subscription key.
+	TokenExchangeUrl          string
+	TokenExchangeClientId     string
+	TokenExchangeClientSecret string
+	TokenExchangeAudience     string
+	TokenExchangeScope        string
 }
 
 func CreateConfig() *Config {
-	return &Config{}
+	return &Config{
+		IdempotencyMaxEntries:  defaultIdempotencyMaxEntries,
+		IdempotencyMaxBodySize: defaultIdempotencyMaxBodySize,
+		TriggerMode:            TriggerModeLink,
+		DefaultProduct:         ProductTracker,
+		PrerequisiteErrorCodes: []string{"PRODUCT_NOT_FOUND", "SIMULATOR_TEMPLATE_NOT_FOUND"},
+	}
 }
 
 type SimulatedPlugin struct {
@@ -26,6 +68,17 @@ type SimulatedPlugin struct {
 	client          *http.Client
 	iotHubUrl       string
 	subscriptionKey string
+	idempotency     *idempotencyStore
+
+	triggerMode       TriggerMode
+	hardwareIdPattern *regexp.Regexp
+	defaultProduct    Product
+	devices           *ensureRegistry
+
+	prerequisites          prerequisites
+	prerequisiteErrorCodes []string
+	provisioned            *ensureRegistry
+	tokenExchanger         *tokenExchanger
 }
 
 type CreateThingRequest struct {
@@ -57,6 +110,13 @@ const (
 	SimulatorTypeManual SimulatorType = "MANUAL"
 )
 
+type TriggerMode string
+
+const (
+	TriggerModeLink TriggerMode = "link"
+	TriggerModeLazy TriggerMode = "lazy"
+)
+
 // LogEvent contains a single log entry
 type LogEvent struct {
 	Level   string    `json:"level"`
@@ -84,6 +144,53 @@ func New(_ context.Context, next http.Handler, config *Config, _ string) (http.H
 		},
 		iotHubUrl:       config.IotHubUrl,
 		subscriptionKey: config.SubscriptionKey,
+		triggerMode:     config.TriggerMode,
+		defaultProduct:  config.DefaultProduct,
+		devices:         newEnsureRegistry(),
+	}
+
+	switch simulatedPlugin.triggerMode {
+	case "":
+		simulatedPlugin.triggerMode = TriggerModeLink
+	case TriggerModeLink, TriggerModeLazy:
+	default:
+		return nil, fmt.Errorf("unknown trigger mode: %s", config.TriggerMode)
+	}
+
+	if config.HardwareIdPathPattern != "" {
+		pattern, err := regexp.Compile(config.HardwareIdPathPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hardware id path pattern: %w", err)
+		}
+		simulatedPlugin.hardwareIdPattern = pattern
+	}
+	if simulatedPlugin.triggerMode == TriggerModeLazy && simulatedPlugin.hardwareIdPattern == nil {
+		return nil, errors.New("lazy trigger mode requires a hardware id path pattern")
+	}
+
+	if config.PrerequisitesFile != "" {
+		prerequisites, err := loadPrerequisites(config.PrerequisitesFile)
+		if err != nil {
+			return nil, err
+		}
+		simulatedPlugin.prerequisites = prerequisites
+		simulatedPlugin.prerequisiteErrorCodes = config.PrerequisiteErrorCodes
+		simulatedPlugin.provisioned = newEnsureRegistry()
+	}
+
+	if config.TokenExchangeUrl != "" {
+		// The identity provider gets its own client, so transports installed for the
+		// hub, such as test cassettes, never see user tokens.
+		tokenClient := &http.Client{Timeout: simulatedPlugin.client.Timeout}
+		simulatedPlugin.tokenExchanger = newTokenExchanger(tokenClient, config)
+	}
+
+	if config.IdempotencyTTL != "" {
+		ttl, err := time.ParseDuration(config.IdempotencyTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid idempotency ttl: %w", err)
+		}
+		simulatedPlugin.idempotency = newIdempotencyStore(ttl, config.IdempotencyMaxEntries, config.IdempotencyMaxBodySize)
 	}
 
 	return simulatedPlugin, nil
@@ -98,68 +205,188 @@ func (plugin *SimulatedPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	key := r.Header.Get(idempotencyKeyHeader)
+	if plugin.idempotency == nil || key == "" {
+		plugin.serve(w, r, body)
+		return
+	}
+
+	storeKey := idempotencyStoreKey(r, key)
+	entry, state := plugin.idempotency.begin(storeKey, idempotencyFingerprint(r, body))
+	switch state {
+	case idempotencyReplay:
+		logInfo("replaying response for idempotency key=%s", key)
+		entry.replay(w)
+		return
+	case idempotencyConflict:
+		logWarn("idempotency key=%s reused with a different request", key)
+		http.Error(w, "idempotency key reused with a different request", http.StatusUnprocessableEntity)
+		return
+	case idempotencyInProgress:
+		logWarn("idempotency key=%s is still being processed", key)
+		http.Error(w, "request with this idempotency key is still being processed", http.StatusConflict)
+		return
+	case idempotencyFull:
+		logWarn("idempotency store full, not storing key=%s", key)
+		plugin.serve(w, r, body)
+		return
+	}
+
+	// abandon also runs when next panics, e.g. with http.ErrAbortHandler when the
+	// client goes away, so the key does not stay reserved.
+	completed := false
+	defer func() {
+		if !completed {
+			plugin.idempotency.abandon(storeKey, entry)
+		}
+	}()
+
+	rec := newResponseRecorder(w, plugin.idempotency.maxBodySize)
+	if plugin.serve(rec, r, body) {
+		plugin.idempotency.complete(storeKey, entry, rec)
+		completed = true
+	}
+}
+
+// serve runs the pipeline of the configured trigger mode. It reports whether the
+// request reached next.
+func (plugin *SimulatedPlugin) serve(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	if plugin.triggerMode == TriggerModeLazy {
+		return plugin.serveLazy(w, r, body)
+	}
+	return plugin.serveLink(w, r, body)
+}
+
+// serveLink creates the simulated device for the device link in body and hands the
+// request to the next handler.
+func (plugin *SimulatedPlugin) serveLink(w http.ResponseWriter, r *http.Request, body []byte) bool {
 	d := json.NewDecoder(bytes.NewReader(body))
 	cr := &CreateThingRequest{}
 	if err := d.Decode(cr); err != nil {
 		logError("error decoding body: %v", err)
 		http.NotFound(w, r)
-		return
+		return false
 	}
 
 	logWarn("found deviceId=%s", cr.DeviceLinkOperation.HardwareId)
-	url, err := url.Parse(plugin.iotHubUrl + "/simulator/simulated/device")
-	if err != nil {
-		logError("error creating url: %v", err)
+	if err := plugin.createSimulatedDevice(r, cr.DeviceLinkOperation); err != nil {
+		logError("%v", err)
 		http.NotFound(w, r)
-		return
+		return false
 	}
 
+	plugin.forward(w, r, body)
+	return true
+}
+
+func (plugin *SimulatedPlugin) createSimulatedDevice(r *http.Request, op DeviceLinkOperation) error {
 	csdr := CreateSimulatedDeviceRequest{
-		HardwareId:    HardwareId(cr.DeviceLinkOperation.HardwareId),
-		Product:       cr.DeviceLinkOperation.Product,
+		HardwareId:    op.HardwareId,
+		Product:       op.Product,
 		SimulatorType: SimulatorTypeManual,
 	}
 
 	var csdrJson bytes.Buffer
 	e := json.NewEncoder(&csdrJson)
 	if err := e.Encode(csdr); err != nil {
-		logError("error encoding create simulated device request: %v", err)
-		http.NotFound(w, r)
-		return
+		return fmt.Errorf("error encoding create simulated device request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url.String(), &csdrJson)
+	rb, err := plugin.postToHub(r, "/simulator/simulated/device", csdrJson.Bytes())
+	if plugin.missingPrerequisites(err) {
+		logWarn("iot hub is missing prerequisites for product=%s", op.Product)
+		perr := plugin.provisioned.ensure(r.Context(), string(op.Product), func() error {
+			return plugin.provisionPrerequisites(r, op.Product)
+		})
+		if perr != nil {
+			return perr
+		}
+		rb, err = plugin.postToHub(r, "/simulator/simulated/device", csdrJson.Bytes())
+	}
 	if err != nil {
-		logError("error encoding create simulated device request: %v", err)
-		http.NotFound(w, r)
-		return
+		return err
+	}
+	logError("iot hub device created: %s", rb)
+	return nil
+}
+
+// postToHub posts body to path on the iot hub on behalf of r and returns the
+// response body.
+func (plugin *SimulatedPlugin) postToHub(r *http.Request, path string, body []byte) ([]byte, error) {
+	url, err := url.Parse(plugin.iotHubUrl + path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating url: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", url.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating iot hub request: %w", err)
 	}
 	for h, v := range r.Header {
 		for _, sv := range v {
 			req.Header.Add(h, sv)
 		}
 	}
-	req.Header.Set("X-Subscription-Key", plugin.subscriptionKey)
+	// The client's key belongs to its own request, not to the hub calls made for it.
+	req.Header.Del(idempotencyKeyHeader)
+	if plugin.tokenExchanger != nil {
+		token, err := plugin.tokenExchanger.hubToken(r)
+		if err != nil {
+			return nil, fmt.Errorf("error exchanging token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		req.Header.Set("X-Subscription-Key", plugin.subscriptionKey)
+	}
 
 	resp, err := plugin.client.Do(req)
 	if err != nil {
-		logError("error performing request to iothub: %v", err)
-		http.NotFound(w, r)
-		return
+		return nil, fmt.Errorf("error performing request to iothub: %w", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
-		logError("iot hub status code error: %s", resp.Status)
-		http.NotFound(w, r)
-		return
+		return nil, newHubStatusError(resp)
 	}
 	rb, err := io.ReadAll(resp.Body)
 	if err != nil {
-		logError("error reading iot hub response: %v", err)
-		http.NotFound(w, r)
-		return
+		return nil, fmt.Errorf("error reading iot hub response: %w", err)
 	}
-	logError("iot hub device created: %s", rb)
+	return rb, nil
+}
+
+// maxHubErrorBodySize bounds how much of a hub error body is read for its code.
+const maxHubErrorBodySize = 64 << 10
+
+// hubStatusError reports a non 2xx response from the iot hub, with the code from its
+// error body when there is one.
+type hubStatusError struct {
+	Status     string
+	StatusCode int
+	Code       string
+}
+
+func newHubStatusError(resp *http.Response) *hubStatusError {
+	e := &hubStatusError{Status: resp.Status, StatusCode: resp.StatusCode}
+	body := struct {
+		Code string `json:"code"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxHubErrorBodySize)).Decode(&body); err == nil {
+		e.Code = body.Code
+	}
+	return e
+}
+
+func (e *hubStatusError) Error() string {
+	return fmt.Sprintf("iot hub status code error: %s", e.Status)
+}
+
+// isHubStatus reports whether err is a hub response with the given status code.
+func isHubStatus(err error, statusCode int) bool {
+	var statusErr *hubStatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == statusCode
+}
 
+func (plugin *SimulatedPlugin) forward(w http.ResponseWriter, r *http.Request, body []byte) {
 	r.Body = NoOpCloser(bytes.NewReader(body))
 	plugin.next.ServeHTTP(w, r)
 }
@@ -0,0 +1,130 @@
+package traefik_create_simulated
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testHub is a fake iot hub recording the requests it receives.
+type testHub struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []testHubRequest
+	handler  http.HandlerFunc
+}
+
+type testHubRequest struct {
+	path   string
+	header http.Header
+	body   string
+}
+
+func newTestHub(t *testing.T, handler http.HandlerFunc) *testHub {
+	t.Helper()
+	hub := &testHub{handler: handler}
+	hub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		hub.mu.Lock()
+		hub.requests = append(hub.requests, testHubRequest{path: r.URL.Path, header: r.Header.Clone(), body: string(b)})
+		hub.mu.Unlock()
+		if hub.handler != nil {
+			hub.handler(w, r)
+		}
+	}))
+	t.Cleanup(hub.Close)
+	return hub
+}
+
+func (hub *testHub) paths() []string {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	paths := make([]string, 0, len(hub.requests))
+	for _, r := range hub.requests {
+		paths = append(paths, r.path)
+	}
+	return paths
+}
+
+func newTestPlugin(t *testing.T, config *Config, next http.Handler) *SimulatedPlugin {
+	t.Helper()
+	handler, err := New(context.Background(), next, config, "test")
+	if err != nil {
+		t.Fatalf("error creating plugin: %v", err)
+	}
+	return handler.(*SimulatedPlugin)
+}
+
+func linkBody(hardwareId string) string {
+	return fmt.Sprintf(`{"deviceLinkOperation":{"identifier":%q,"product":"TRACKER"}}`, hardwareId)
+}
+
+func serve(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestServeHTTP_Link(t *testing.T) {
+	hub := newTestHub(t, nil)
+	var nextBody string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		nextBody = string(b)
+		w.WriteHeader(http.StatusCreated)
+	})
+	config := CreateConfig()
+	config.IotHubUrl = hub.URL
+	config.SubscriptionKey = "subscription-key"
+	plugin := newTestPlugin(t, config, next)
+
+	w := serve(plugin, httptest.NewRequest("POST", "/link", strings.NewReader(linkBody("hw-1"))))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusCreated)
+	}
+	if nextBody != linkBody("hw-1") {
+		t.Errorf("next body = %q, want the original body", nextBody)
+	}
+	if len(hub.requests) != 1 {
+		t.Fatalf("hub requests = %d, want 1", len(hub.requests))
+	}
+	req := hub.requests[0]
+	if req.path != "/simulator/simulated/device" {
+		t.Errorf("hub path = %s", req.path)
+	}
+	if want := `{"hardwareId":"hw-1","productId":"TRACKER","simulatorType":"MANUAL"}` + "\n"; req.body != want {
+		t.Errorf("hub body = %q, want %q", req.body, want)
+	}
+	if got := req.header.Get("X-Subscription-Key"); got != "subscription-key" {
+		t.Errorf("X-Subscription-Key = %q", got)
+	}
+}
+
+func TestServeHTTP_HubError(t *testing.T) {
+	// An existing device is an error in link mode, unlike in lazy mode.
+	for _, status := range []int{http.StatusInternalServerError, http.StatusConflict} {
+		hub := newTestHub(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+		nextCalled := false
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { nextCalled = true })
+		config := CreateConfig()
+		config.IotHubUrl = hub.URL
+		plugin := newTestPlugin(t, config, next)
+
+		w := serve(plugin, httptest.NewRequest("POST", "/link", strings.NewReader(linkBody("hw-1"))))
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("hub %d: status = %d, want %d", status, w.Code, http.StatusNotFound)
+		}
+		if nextCalled {
+			t.Errorf("hub %d: next called after hub error", status)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package traefik_create_simulated
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenExchangeGrantType   = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType          = "urn:ietf:params:oauth:token-type:access_token"
+	defaultTokenLifetime     = time.Minute
+	tokenExpirySkew          = 10 * time.Second
+	maxTokenExchangeRespSize = 1 << 20
+)
+
+var errMissingBearerToken = errors.New("missing bearer token")
+
+// tokenExchanger exchanges the client's bearer token for a hub scoped token
+// (RFC 8693) and caches the result per subject token.
+type tokenExchanger struct {
+	client       *http.Client
+	url          string
+	clientId     string
+	clientSecret string
+	audience     string
+	scope        string
+
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+}
+
+type cachedToken struct {
+	accessToken string
+	expires     time.Time
+}
+
+type tokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+}
+
+func newTokenExchanger(client *http.Client, config *Config) *tokenExchanger {
+	return &tokenExchanger{
+		client:       client,
+		url:          config.TokenExchangeUrl,
+		clientId:     config.TokenExchangeClientId,
+		clientSecret: config.TokenExchangeClientSecret,
+		audience:     config.TokenExchangeAudience,
+		scope:        config.TokenExchangeScope,
+		tokens:       map[string]cachedToken{},
+	}
+}
+
+// hubToken returns the hub scoped token for the bearer token of r.
+func (exchanger *tokenExchanger) hubToken(r *http.Request) (string, error) {
+	subjectToken := bearerToken(r)
+	if subjectToken == "" {
+		return "", errMissingBearerToken
+	}
+	cacheKey := tokenCacheKey(subjectToken)
+
+	now := time.Now()
+	exchanger.mu.Lock()
+	cached, ok := exchanger.tokens[cacheKey]
+	exchanger.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.accessToken, nil
+	}
+
+	resp, err := exchanger.exchange(subjectToken)
+	if err != nil {
+		return "", err
+	}
+
+	lifetime := defaultTokenLifetime
+	if resp.ExpiresIn > 0 {
+		lifetime = time.Duration(resp.ExpiresIn) * time.Second
+	}
+	if lifetime > tokenExpirySkew {
+		lifetime -= tokenExpirySkew
+	}
+	expires := now.Add(lifetime)
+	// The hub token must not outlive the token it was exchanged from.
+	if exp, ok := tokenExpiry(subjectToken); ok && exp.Before(expires) {
+		expires = exp
+	}
+	if !now.Before(expires) {
+		return resp.AccessToken, nil
+	}
+
+	exchanger.mu.Lock()
+	defer exchanger.mu.Unlock()
+	for s, token := range exchanger.tokens {
+		if now.After(token.expires) {
+			delete(exchanger.tokens, s)
+		}
+	}
+	exchanger.tokens[cacheKey] = cachedToken{
+		accessToken: resp.AccessToken,
+		expires:     expires,
+	}
+	return resp.AccessToken, nil
+}
+
+func (exchanger *tokenExchanger) exchange(subjectToken string) (*tokenExchangeResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", tokenExchangeGrantType)
+	form.Set("subject_token", subjectToken)
+	form.Set("subject_token_type", accessTokenType)
+	form.Set("requested_token_type", accessTokenType)
+	if exchanger.audience != "" {
+		form.Set("audience", exchanger.audience)
+	}
+	if exchanger.scope != "" {
+		form.Set("scope", exchanger.scope)
+	}
+
+	req, err := http.NewRequest("POST", exchanger.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("error creating token exchange request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if exchanger.clientId != "" {
+		req.SetBasicAuth(url.QueryEscape(exchanger.clientId), url.QueryEscape(exchanger.clientSecret))
+	}
+
+	resp, err := exchanger.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error performing token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token exchange status code error: %s", resp.Status)
+	}
+
+	ter := &tokenExchangeResponse{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxTokenExchangeRespSize)).Decode(ter); err != nil {
+		return nil, fmt.Errorf("error decoding token exchange response: %w", err)
+	}
+	if ter.AccessToken == "" {
+		return nil, errors.New("token exchange response has no access_token")
+	}
+	if ter.TokenType != "" && !strings.EqualFold(ter.TokenType, "bearer") {
+		return nil, fmt.Errorf("unsupported token exchange token_type: %s", ter.TokenType)
+	}
+	return ter, nil
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// tokenCacheKey identifies the subject token in the cache. The whole token is hashed,
+// so a cached hub token is only handed out for the exact token it was exchanged for.
+func tokenCacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenExpiry returns the exp claim of a JWT. The token is not verified, so the claim
+// is only used to shorten how long an exchanged token is cached.
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	claims := struct {
+		Exp int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
@@ -0,0 +1,197 @@
+package traefik_create_simulated
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTokenEndpoint is a fake RFC 8693 token endpoint issuing hub-<n> tokens.
+type testTokenEndpoint struct {
+	*httptest.Server
+	mu    sync.Mutex
+	forms []url.Values
+	auth  []string
+}
+
+func newTestTokenEndpoint(t *testing.T) *testTokenEndpoint {
+	t.Helper()
+	endpoint := &testTokenEndpoint{}
+	endpoint.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		user, password, _ := r.BasicAuth()
+		endpoint.mu.Lock()
+		endpoint.forms = append(endpoint.forms, r.PostForm)
+		endpoint.auth = append(endpoint.auth, user+":"+password)
+		n := len(endpoint.forms)
+		endpoint.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"access_token":"hub-%d","issued_token_type":%q,"token_type":"Bearer","expires_in":3600}`, n, accessTokenType)
+	}))
+	t.Cleanup(endpoint.Close)
+	return endpoint
+}
+
+func newTokenExchangePlugin(t *testing.T, hub *testHub, endpoint *testTokenEndpoint) *SimulatedPlugin {
+	t.Helper()
+	config := CreateConfig()
+	config.IotHubUrl = hub.URL
+	config.SubscriptionKey = "subscription-key"
+	config.TokenExchangeUrl = endpoint.URL
+	config.TokenExchangeClientId = "plugin"
+	config.TokenExchangeClientSecret = "secret"
+	config.TokenExchangeAudience = "iothub"
+	config.TokenExchangeScope = "devices:write"
+	return newTestPlugin(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+func testJWT(claims string) string {
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".sig"
+}
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest("POST", "/link", strings.NewReader(linkBody("hw-1")))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestTokenExchange_Form(t *testing.T) {
+	hub := newTestHub(t, nil)
+	endpoint := newTestTokenEndpoint(t)
+	plugin := newTokenExchangePlugin(t, hub, endpoint)
+
+	token := testJWT(`{"sub":"alice"}`)
+	if w := serve(plugin, bearerRequest(token)); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	if len(endpoint.forms) != 1 {
+		t.Fatalf("exchanges = %d, want 1", len(endpoint.forms))
+	}
+	form := endpoint.forms[0]
+	for field, want := range map[string]string{
+		"grant_type":           tokenExchangeGrantType,
+		"subject_token":        token,
+		"subject_token_type":   accessTokenType,
+		"requested_token_type": accessTokenType,
+		"audience":             "iothub",
+		"scope":                "devices:write",
+	} {
+		if got := form.Get(field); got != want {
+			t.Errorf("%s = %q, want %q", field, got, want)
+		}
+	}
+	if endpoint.auth[0] != "plugin:secret" {
+		t.Errorf("client credentials = %q", endpoint.auth[0])
+	}
+
+	header := hub.requests[0].header
+	if got := header.Get("Authorization"); got != "Bearer hub-1" {
+		t.Errorf("hub Authorization = %q, want %q", got, "Bearer hub-1")
+	}
+	if got := header.Get("X-Subscription-Key"); got != "" {
+		t.Errorf("hub X-Subscription-Key = %q, want none", got)
+	}
+}
+
+func TestTokenExchange_OwnClient(t *testing.T) {
+	hub := newTestHub(t, nil)
+	endpoint := newTestTokenEndpoint(t)
+	plugin := newTokenExchangePlugin(t, hub, endpoint)
+
+	// A transport installed for the hub only must not receive identity provider calls.
+	hubTransport := &hostTransport{host: strings.TrimPrefix(hub.URL, "http://")}
+	plugin.client.Transport = hubTransport
+
+	if w := serve(plugin, bearerRequest(testJWT(`{"sub":"alice"}`))); w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if hubTransport.rejected != 0 {
+		t.Errorf("hub transport received %d requests for other hosts", hubTransport.rejected)
+	}
+	if plugin.tokenExchanger.client.Timeout != plugin.client.Timeout {
+		t.Errorf("token client timeout = %v, want %v", plugin.tokenExchanger.client.Timeout, plugin.client.Timeout)
+	}
+}
+
+// hostTransport only serves requests for host.
+type hostTransport struct {
+	host     string
+	rejected int
+}
+
+func (transport *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != transport.host {
+		transport.rejected++
+		return nil, fmt.Errorf("unexpected host %s", req.URL.Host)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestTokenExchange_Cache(t *testing.T) {
+	hub := newTestHub(t, nil)
+	endpoint := newTestTokenEndpoint(t)
+	plugin := newTokenExchangePlugin(t, hub, endpoint)
+
+	token := testJWT(`{"iss":"idp","sub":"alice"}`)
+	serve(plugin, bearerRequest(token))
+	serve(plugin, bearerRequest(token))
+	if len(endpoint.forms) != 1 {
+		t.Errorf("exchanges = %d, want 1", len(endpoint.forms))
+	}
+
+	// A different token claiming the same subject is exchanged on its own.
+	serve(plugin, bearerRequest(testJWT(`{"iss":"idp","sub":"alice","forged":true}`)))
+	if len(endpoint.forms) != 2 {
+		t.Errorf("exchanges = %d, want 2", len(endpoint.forms))
+	}
+	if got := hub.requests[2].header.Get("Authorization"); got != "Bearer hub-2" {
+		t.Errorf("hub Authorization = %q, want %q", got, "Bearer hub-2")
+	}
+}
+
+func TestTokenExchange_CappedBySubjectExpiry(t *testing.T) {
+	endpoint := newTestTokenEndpoint(t)
+	exchanger := newTokenExchanger(http.DefaultClient, &Config{TokenExchangeUrl: endpoint.URL})
+
+	exp := time.Now().Add(30 * time.Second).Unix()
+	token := testJWT(fmt.Sprintf(`{"sub":"alice","exp":%d}`, exp))
+	if _, err := exchanger.hubToken(bearerRequest(token)); err != nil {
+		t.Fatalf("exchanging token: %v", err)
+	}
+	if cached := exchanger.tokens[tokenCacheKey(token)]; cached.expires.Unix() > exp {
+		t.Errorf("cached until %v, after the subject token expires at %v", cached.expires, time.Unix(exp, 0))
+	}
+
+	expired := testJWT(fmt.Sprintf(`{"sub":"alice","exp":%d}`, time.Now().Add(-time.Minute).Unix()))
+	if _, err := exchanger.hubToken(bearerRequest(expired)); err != nil {
+		t.Fatalf("exchanging token: %v", err)
+	}
+	if _, ok := exchanger.tokens[tokenCacheKey(expired)]; ok {
+		t.Error("hub token cached for an expired subject token")
+	}
+}
+
+func TestTokenExchange_MissingBearerToken(t *testing.T) {
+	hub := newTestHub(t, nil)
+	endpoint := newTestTokenEndpoint(t)
+	plugin := newTokenExchangePlugin(t, hub, endpoint)
+
+	if w := serve(plugin, bearerRequest("")); w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if len(hub.requests) != 0 || len(endpoint.forms) != 0 {
+		t.Errorf("hub calls = %d, exchanges = %d, want none", len(hub.requests), len(endpoint.forms))
+	}
+}